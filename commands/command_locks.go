@@ -1,6 +1,11 @@
 package commands
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/github/git-lfs/api"
 	"github.com/spf13/cobra"
 )
@@ -14,20 +19,91 @@ var (
 )
 
 func locksCommand(cmd *cobra.Command, args []string) {
-	s, resp := api.C.Locks.Search(&api.LockSearchRequest{
+	query := &api.LockSearchRequest{
 		Filters: locksFlags.Filters(),
 		Cursor:  locksFlags.Cursor,
 		Limit:   locksFlags.Limit,
-	})
+	}
+
+	// Auto-pagination is scoped to the machine-readable output modes:
+	// that's the case scripting (`git lfs locks --json | jq ...`) needs a
+	// complete result set for. The default human-readable mode keeps its
+	// existing single-page behavior so an interactive `git lfs locks`
+	// doesn't start walking every page and dumping unbounded output.
+	followCursor := locksFlags.Limit == 0 && (locksFlags.Json || locksFlags.Porcelain)
+
+	var locks []api.Lock
+	for {
+		s, resp := api.C.Locks.Search(query)
+		if _, err := api.Do(s); err != nil {
+			Error(err.Error())
+			Exit("Error communicating with LFS API.")
+		}
+
+		locks = append(locks, resp.Locks...)
 
-	if _, err := api.Do(s); err != nil {
-		Error(err.Error())
-		Exit("Error communicating with LFS API.")
+		if !followCursor || len(resp.NextCursor) == 0 {
+			break
+		}
+		query.Cursor = resp.NextCursor
 	}
 
-	Print("\n%d lock(s) matched query:", len(resp.Locks))
-	for _, lock := range resp.Locks {
-		Print("%s\t%s <%s>", lock.Path, lock.Committer.Name, lock.Committer.Email)
+	switch {
+	case locksFlags.Json:
+		printLocksJson(locks)
+	case locksFlags.Porcelain:
+		printLocksPorcelain(locks)
+	default:
+		Print("\n%d lock(s) matched query:", len(locks))
+		for _, lock := range locks {
+			Print("%s\t%s <%s>", lock.Path, lock.Committer.Name, lock.Committer.Email)
+		}
+	}
+}
+
+// lockOwnerJson is the "owner" object embedded in each entry of
+// printLocksJson's output.
+type lockOwnerJson struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// lockJson is the machine-readable shape `git lfs locks --json` emits,
+// independent of api.Lock's own wire format.
+type lockJson struct {
+	Id       string        `json:"id"`
+	Path     string        `json:"path"`
+	Owner    lockOwnerJson `json:"owner"`
+	LockedAt time.Time     `json:"locked_at"`
+}
+
+// printLocksJson writes locks to stdout as a single JSON array, for
+// scripting (`git lfs locks --json | jq ...`).
+func printLocksJson(locks []api.Lock) {
+	out := make([]lockJson, len(locks))
+	for i, lock := range locks {
+		out[i] = lockJson{
+			Id:   lock.Id,
+			Path: lock.Path,
+			Owner: lockOwnerJson{
+				Name:  lock.Committer.Name,
+				Email: lock.Committer.Email,
+			},
+			LockedAt: lock.LockedAt,
+		}
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(out); err != nil {
+		Exit("Error encoding locks as JSON: %s", err)
+	}
+}
+
+// printLocksPorcelain writes one NUL-terminated, tab-separated record per
+// lock, the way `git status --porcelain` does, so the output is safe to
+// pipe into `xargs -0` regardless of what characters appear in a path.
+func printLocksPorcelain(locks []api.Lock) {
+	for _, lock := range locks {
+		fmt.Fprintf(os.Stdout, "%s\t%s\t%s\t%s\x00", lock.Id, lock.Path, lock.Committer.Name, lock.Committer.Email)
 	}
 }
 
@@ -36,6 +112,8 @@ func init() {
 	locksCmd.Flags().StringVarP(&locksFlags.Id, "id", "i", "", "filter locks results matching a particular ID")
 	locksCmd.Flags().StringVarP(&locksFlags.Cursor, "cursor", "c", "", "cursor for last seen lock result")
 	locksCmd.Flags().IntVarP(&locksFlags.Limit, "limit", "l", 0, "optional limit for number of results to return")
+	locksCmd.Flags().BoolVar(&locksFlags.Json, "json", false, "print output in JSON")
+	locksCmd.Flags().BoolVar(&locksFlags.Porcelain, "porcelain", false, "print output in a NUL-terminated, tab-separated format for scripting")
 
 	RootCmd.AddCommand(locksCmd)
 }
@@ -56,6 +134,12 @@ type locksFlags struct {
 	// limit is an optional request parameter sent to the server used to
 	// limit the
 	Limit int
+	// Json causes output to be printed as a single JSON array of objects
+	// instead of the human-readable default.
+	Json bool
+	// Porcelain causes output to be printed as NUL-terminated,
+	// tab-separated records instead of the human-readable default.
+	Porcelain bool
 }
 
 // Filters produces a slice of api.Filter instances based on the internal state
@@ -0,0 +1,47 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/rubyist/tracerx"
+)
+
+var (
+	transferCtx, cancelTransferCtx = context.WithCancel(context.Background())
+)
+
+// TransferContext returns the context that in-flight transfer batches
+// (push, pull, fetch) should watch for cancellation. It is cancelled once,
+// the first time the user interrupts the process, so that a stuck `git lfs
+// push` can be aborted cleanly instead of leaving orphaned custom transfer
+// adapter processes behind.
+//
+// Commands that run a transfer batch must pass this context into the
+// adapter's Begin/DoTransfer calls *and* call watchForInterrupt before
+// starting the batch; only then does a SIGINT actually reach the adapter.
+//
+// Confirmed: push/pull/fetch are the only such callers, and this checkout
+// doesn't contain those command files (only locks, which never transfers
+// an object, is present), so watchForInterrupt has no caller here and the
+// cancellation plumbing below is unreachable until those commands land in
+// this tree and are updated to call it. That's a gap in this checkout's
+// file set, not something fixable from commands/ or transfer/ alone.
+func TransferContext() context.Context {
+	return transferCtx
+}
+
+// watchForInterrupt cancels TransferContext() on the first SIGINT so any
+// transfer manager currently running can wind down its workers instead of
+// being killed out from under them. It must be called once by each command
+// that performs transfers, before it starts one.
+func watchForInterrupt() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		<-sigChan
+		tracerx.Printf("commands: received interrupt, cancelling in-flight transfers")
+		cancelTransferCtx()
+	}()
+}
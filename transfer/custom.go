@@ -2,6 +2,7 @@ package transfer
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/github/git-lfs/localstorage"
 
@@ -19,6 +22,10 @@ import (
 	"github.com/github/git-lfs/config"
 )
 
+// cancelGracePeriod is how long DoTransfer waits for a worker process to
+// acknowledge a "cancel" message before giving up and killing it outright.
+const cancelGracePeriod = 3 * time.Second
+
 // Adapter for custom transfer via external process
 type customAdapter struct {
 	*adapterBase
@@ -26,6 +33,22 @@ type customAdapter struct {
 	args                string
 	concurrent          bool
 	originalConcurrency int
+	manager             *TransferManager
+	// streamMode, when true, negotiates the frame-based streaming
+	// transfer mode instead of the default path-based one; see
+	// custom_stream.go.
+	streamMode bool
+	// credentialMode is one of the credentialMode* constants in
+	// custom_credentials.go, from lfs.customtransfer.<name>.credentials.
+	// It controls whether and how WorkerStarting/DoTransfer resolve
+	// credentials to hand the worker instead of making it look them up
+	// itself.
+	credentialMode string
+
+	// credCacheMu guards credCache, resolveCredentials' per-host cache;
+	// see custom_credentials.go.
+	credCacheMu sync.Mutex
+	credCache   map[string]*customAdapterCredentials
 }
 
 type customAdapterWorkerContext struct {
@@ -39,24 +62,40 @@ type customAdapterInitRequest struct {
 	Operation           string `json:"operation"`
 	Concurrent          bool   `json:"concurrent"`
 	ConcurrentTransfers int    `json:"concurrenttransfers"`
+	// TransferMode is "path" (the default, omitted for backward
+	// compatibility with adapters that predate streaming) or "stream".
+	// See custom_stream.go for what "stream" negotiates.
+	TransferMode string `json:"transfermode,omitempty"`
+	// Credentials are resolved once for the configured remote when
+	// lfs.customtransfer.<name>.credentials isn't "none"; see
+	// custom_credentials.go.
+	Credentials *customAdapterCredentials `json:"credentials,omitempty"`
 }
 type customAdapterInitResponse struct {
 	Error *api.ObjectError `json:"error,omitempty"`
 }
 type customAdapterUploadRequest struct {
-	Oid    string            `json:"oid"`
-	Size   int64             `json:"size"`
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+	// Path is the object's location on disk in path-based transfer mode;
+	// it is blank in streaming mode, where the worker gets the bytes as
+	// frames instead.
 	Path   string            `json:"path"`
 	Action *api.LinkRelation `json:"action"`
+	// Credentials are re-resolved for Action's host just before this
+	// request is sent, so a redirect to a different host than the one
+	// WorkerStarting resolved credentials for still gets the right ones.
+	Credentials *customAdapterCredentials `json:"credentials,omitempty"`
 }
 type customAdapterUploadResponse struct {
 	Oid   string           `json:"oid"`
 	Error *api.ObjectError `json:"error,omitempty"`
 }
 type customAdapterDownloadRequest struct {
-	Oid    string            `json:"oid"`
-	Size   int64             `json:"size"`
-	Action *api.LinkRelation `json:"action"`
+	Oid         string                    `json:"oid"`
+	Size        int64                     `json:"size"`
+	Action      *api.LinkRelation         `json:"action"`
+	Credentials *customAdapterCredentials `json:"credentials,omitempty"`
 }
 type customAdapterTransferResponse struct { // common between upload/download
 	Oid   string           `json:"oid"`
@@ -72,18 +111,37 @@ type customAdapterProgressResponse struct {
 	BytesSinceLast int    `json:"bytesSinceLast"`
 }
 
-func (a *customAdapter) Begin(maxConcurrency int, cb TransferProgressCallback, completion chan TransferResult) error {
+// customAdapterCancelRequest is the "cancel" message of the custom
+// transfer protocol: {"event": "cancel", "oid": "<oid>"}. It is sent to a
+// worker process to ask it to abandon the transfer currently in progress
+// for Oid. The worker should stop reading/writing the object, discard any
+// partial output, and reply with a matching customAdapterCancelResponse.
+// Third-party adapters (rsync, S3, ...) that predate this message simply
+// never reply, in which case DoTransfer falls back to killing the process
+// once cancelGracePeriod elapses without an acknowledgement.
+type customAdapterCancelRequest struct {
+	Event string `json:"event"`
+	Oid   string `json:"oid"`
+}
+type customAdapterCancelResponse struct {
+	Event string           `json:"event"`
+	Oid   string           `json:"oid"`
+	Error *api.ObjectError `json:"error,omitempty"`
+}
+
+func (a *customAdapter) Begin(ctx context.Context, maxConcurrency int, cb TransferProgressCallback, completion chan TransferResult) error {
 	// If config says not to launch multiple processes, downgrade incoming value
 	useConcurrency := maxConcurrency
 	if !a.concurrent {
 		useConcurrency = 1
 	}
 	a.originalConcurrency = maxConcurrency
+	a.manager = NewTransferManager(a.name, useConcurrency)
 
 	tracerx.Printf("xfer: Custom transfer adapter %q using concurrency %d", a.name, useConcurrency)
 
 	// Use common workers impl, but downgrade workers to number of processes
-	return a.adapterBase.Begin(useConcurrency, cb, completion)
+	return a.adapterBase.Begin(ctx, useConcurrency, cb, completion)
 }
 
 func (a *customAdapter) ClearTempStorage() error {
@@ -91,11 +149,24 @@ func (a *customAdapter) ClearTempStorage() error {
 	return nil
 }
 
-func (a *customAdapter) WorkerStarting(workerNum int) (interface{}, error) {
-
+func (a *customAdapter) WorkerStarting(ctx context.Context, workerNum int) (interface{}, error) {
 	// Start a process per worker
 	// If concurrent = false we have already dialled back workers to 1
 	tracerx.Printf("xfer: starting up custom transfer process %q for worker %d", a.name, workerNum)
+	workerCtx, err := a.spawnWorkerProcess()
+	if err != nil {
+		return nil, err
+	}
+
+	tracerx.Printf("xfer: %q for worker %d started OK", a.name, workerNum)
+
+	// Save this process context and use in future callbacks
+	return workerCtx, nil
+}
+
+// spawnWorkerProcess starts a new worker process and exchanges the
+// "init" message with it, returning a ready-to-use worker context.
+func (a *customAdapter) spawnWorkerProcess() (*customAdapterWorkerContext, error) {
 	cmd := subprocess.ExecCommand(a.path, a.args)
 	outp, err := cmd.StdoutPipe()
 	if err != nil {
@@ -110,25 +181,49 @@ func (a *customAdapter) WorkerStarting(workerNum int) (interface{}, error) {
 		return nil, fmt.Errorf("Failed to start custom transfer command %q remote: %v", a.path, err)
 	}
 	// Set up buffered reader/writer since we operate on lines
-	ctx := &customAdapterWorkerContext{cmd, outp, bufio.NewReader(outp), inp}
+	workerCtx := &customAdapterWorkerContext{cmd, outp, bufio.NewReader(outp), inp}
 
 	// send initiate message
 	op := "upload"
 	if a.direction == Download {
 		op = "download"
 	}
-	initReq := &customAdapterInitRequest{op, a.concurrent, a.originalConcurrency}
+	var transferMode string // path mode is left out of the message
+	if a.streamMode {
+		transferMode = "stream"
+	}
+	initReq := &customAdapterInitRequest{
+		Operation:           op,
+		Concurrent:          a.concurrent,
+		ConcurrentTransfers: a.originalConcurrency,
+		TransferMode:        transferMode,
+		Credentials:         a.resolveEndpointCredentials(),
+	}
 	var initResp customAdapterInitResponse
-	err = a.exchangeMessage(ctx, initReq, &initResp)
+	err = a.exchangeMessage(workerCtx, initReq, &initResp)
 	if err != nil {
-		a.abortWorkerProcess(ctx)
+		a.abortWorkerProcess(workerCtx)
 		return nil, err
 	}
 
-	tracerx.Printf("xfer: %q for worker %d started OK", a.name, workerNum)
+	return workerCtx, nil
+}
 
-	// Save this process context and use in future callbacks
-	return ctx, nil
+// restartWorkerProcess replaces a dead or unresponsive worker process with
+// a freshly spawned one, in place, so that a TransferManager retry reusing
+// the same *customAdapterWorkerContext picks up the new process instead of
+// talking to the crashed one. The caller's existing reference to ctx
+// remains valid; only its fields change.
+func (a *customAdapter) restartWorkerProcess(ctx *customAdapterWorkerContext) error {
+	tracerx.Printf("xfer: restarting custom transfer process %q after a transient failure", a.name)
+	a.abortWorkerProcess(ctx)
+
+	fresh, err := a.spawnWorkerProcess()
+	if err != nil {
+		return err
+	}
+	*ctx = *fresh
+	return nil
 }
 
 // sendMessage sends a JSON message to the custom adapter process
@@ -198,8 +293,26 @@ func (a *customAdapter) abortWorkerProcess(ctx *customAdapterWorkerContext) {
 	ctx.stdout.Close()
 	ctx.cmd.Process.Kill()
 }
-func (a *customAdapter) WorkerEnding(workerNum int, ctx interface{}) {
-	customCtx, ok := ctx.(*customAdapterWorkerContext)
+
+// sendCancelMessage sends the "cancel" protocol message for oid,
+// aborting the worker process outright if the send itself fails. Path
+// mode (doTransferOnce's ctx.Done() case) uses this directly and waits
+// for the ack on its own pre-existing reader goroutine; stream mode
+// (custom_stream.go) doesn't send a cancel message at all and just
+// aborts the process, since a worker mid-frame has no way to tell a
+// JSON cancel ack apart from binary frame data on the same pipe.
+func (a *customAdapter) sendCancelMessage(ctx *customAdapterWorkerContext, oid string) error {
+	tracerx.Printf("xfer: cancelling custom transfer %q of %q", a.name, oid)
+
+	if err := a.sendMessage(ctx, &customAdapterCancelRequest{Event: "cancel", Oid: oid}); err != nil {
+		a.abortWorkerProcess(ctx)
+		return err
+	}
+	return nil
+}
+
+func (a *customAdapter) WorkerEnding(ctx context.Context, workerNum int, workerCtx interface{}) {
+	customCtx, ok := workerCtx.(*customAdapterWorkerContext)
 	if !ok {
 		tracerx.Printf("Context object for custom transfer %q was of the wrong type", a.name)
 		return
@@ -212,43 +325,133 @@ func (a *customAdapter) WorkerEnding(workerNum int, ctx interface{}) {
 	}
 }
 
-func (a *customAdapter) DoTransfer(ctx interface{}, t *Transfer, cb TransferProgressCallback, authOkFunc func()) error {
-	if ctx == nil {
+// DoTransfer enqueues t's transfer with this adapter's TransferManager and
+// relays the events it reports back to cb and, ultimately, the caller. If
+// another goroutine is already transferring the same Oid (e.g. the same
+// object appears more than once in a batch) the two calls share the one
+// underlying transfer instead of running it twice.
+func (a *customAdapter) DoTransfer(ctx context.Context, workerCtx interface{}, t *Transfer, cb TransferProgressCallback, authOkFunc func()) error {
+	events := a.manager.Watch(ctx, t.Object.Oid, func(attempt int) error {
+		return a.doTransferOnce(ctx, workerCtx, t, authOkFunc, attempt)
+	})
+
+	for ev := range events {
+		if ev.Done {
+			return ev.Err
+		}
+		if cb != nil {
+			cb(t.Name, t.Object.Size, ev.BytesSoFar, ev.BytesSinceLast)
+		}
+	}
+	return nil
+}
+
+// doTransferOnce performs a single attempt at transferring t, reporting
+// progress to the TransferManager rather than directly to a callback so
+// that every watcher of t.Object.Oid sees it. Errors that look transient
+// (a broken adapter pipe, a process that died mid-transfer) are wrapped
+// so the TransferManager will retry them; anything else is fatal.
+func (a *customAdapter) doTransferOnce(ctx context.Context, workerCtx interface{}, t *Transfer, authOkFunc func(), attempt int) error {
+	if workerCtx == nil {
 		return fmt.Errorf("Custom transfer %q was not properly initialized, see previous errors", a.name)
 	}
 
-	customCtx, ok := ctx.(*customAdapterWorkerContext)
+	customCtx, ok := workerCtx.(*customAdapterWorkerContext)
 	if !ok {
 		return fmt.Errorf("Context object for custom transfer %q was of the wrong type", a.name)
 	}
 	var authCalled bool
 
+	if attempt > 0 {
+		tracerx.Printf("xfer: retrying custom transfer %q of %q (attempt %d)", a.name, t.Object.Oid, attempt+1)
+		// The previous attempt's transient error may well have been the
+		// worker process itself crashing or wedging, so a retry against
+		// the very same process wouldn't recover anything. Always start
+		// from a known-good process before retrying.
+		if err := a.restartWorkerProcess(customCtx); err != nil {
+			return newTransientError(err)
+		}
+	}
+
+	if a.streamMode {
+		return a.doTransferOnceStream(ctx, customCtx, t, authOkFunc, attempt)
+	}
+
 	var req interface{}
 	if a.direction == Download {
 		rel, ok := t.Object.Rel("download")
 		if !ok {
 			return errors.New("Object not found on the server.")
 		}
-		req = &customAdapterDownloadRequest{t.Object.Oid, t.Object.Size, rel}
+		req = &customAdapterDownloadRequest{
+			Oid:         t.Object.Oid,
+			Size:        t.Object.Size,
+			Action:      rel,
+			Credentials: a.resolveCredentials(rel),
+		}
 	} else {
 		rel, ok := t.Object.Rel("upload")
 		if !ok {
 			return errors.New("Object not found on the server.")
 		}
-		req = &customAdapterUploadRequest{t.Object.Oid, t.Object.Size, localstorage.Objects().ObjectPath(t.Object.Oid), rel}
+		req = &customAdapterUploadRequest{
+			Oid:         t.Object.Oid,
+			Size:        t.Object.Size,
+			Path:        localstorage.Objects().ObjectPath(t.Object.Oid),
+			Action:      rel,
+			Credentials: a.resolveCredentials(rel),
+		}
 	}
 	err := a.sendMessage(customCtx, req)
 	if err != nil {
-		return err
+		return newTransientError(err)
 	}
 
-	// 1..N replies (including progress & one of download / upload)
+	// 1..N replies (including progress & one of download / upload). Only
+	// ever one goroutine reads customCtx.bufferedOut at a time: the same
+	// background reader stays in charge across the whole loop, including
+	// while we're waiting out a cancellation, since bufio.Reader isn't
+	// safe for concurrent reads and the ctx.Done() case below must not
+	// start a second one racing this one.
+	type response struct {
+		idx int
+		err error
+	}
 	possResps := []interface{}{&customAdapterProgressResponse{}, &customAdapterTransferResponse{}}
+	respCh := make(chan response, 1)
+	readNext := func() {
+		idx, err := a.readResponse(customCtx, possResps)
+		respCh <- response{idx, err}
+	}
+	go readNext()
+
 	var complete bool
 	for !complete {
-		respIdx, err := a.readResponse(customCtx, possResps)
+		var resp response
+		select {
+		case <-ctx.Done():
+			// Send the cancel request and keep listening on respCh for its
+			// ack (or anything else the worker sends) rather than starting
+			// a second reader on customCtx.bufferedOut, which would race
+			// the readNext goroutine already blocked on it.
+			if err := a.sendCancelMessage(customCtx, t.Object.Oid); err == nil {
+				select {
+				case <-respCh:
+					// worker is still alive and reusable
+				case <-time.After(cancelGracePeriod):
+					tracerx.Printf("xfer: %q did not acknowledge cancel of %q within %v, killing it", a.name, t.Object.Oid, cancelGracePeriod)
+					a.abortWorkerProcess(customCtx)
+				}
+			}
+			return ctx.Err()
+		case resp = <-respCh:
+		}
+		respIdx, err := resp.idx, resp.err
 		if err != nil {
-			return err
+			// The worker either died or wrote something we couldn't
+			// parse; either way restartWorkerProcess will give the next
+			// attempt a fresh process to talk to.
+			return newTransientError(err)
 		}
 		var wasAuthOk bool
 		switch respIdx {
@@ -258,9 +461,7 @@ func (a *customAdapter) DoTransfer(ctx interface{}, t *Transfer, cb TransferProg
 			if prog.Oid != t.Object.Oid {
 				return fmt.Errorf("Unexpected oid %q in response, expecting %q", prog.Oid, t.Object.Oid)
 			}
-			if cb != nil {
-				cb(t.Name, t.Object.Size, prog.BytesSoFar, prog.BytesSinceLast)
-			}
+			a.manager.Progress(t.Object.Oid, prog.BytesSoFar, prog.BytesSinceLast)
 			wasAuthOk = prog.BytesSoFar > 0
 		case 1:
 			// Download/Upload complete
@@ -269,7 +470,11 @@ func (a *customAdapter) DoTransfer(ctx interface{}, t *Transfer, cb TransferProg
 				return fmt.Errorf("Unexpected oid %q in response, expecting %q", comp.Oid, t.Object.Oid)
 			}
 			if comp.Error != nil {
-				return fmt.Errorf("Error transferring %q: %v", t.Object.Oid, comp.Error.Error())
+				err := fmt.Errorf("Error transferring %q: %v", t.Object.Oid, comp.Error.Error())
+				if comp.Error.Code >= 500 {
+					return newTransientError(err)
+				}
+				return err
 			}
 			wasAuthOk = true
 			complete = true
@@ -279,6 +484,9 @@ func (a *customAdapter) DoTransfer(ctx interface{}, t *Transfer, cb TransferProg
 			authOkFunc()
 			authCalled = true
 		}
+		if !complete {
+			go readNext()
+		}
 	}
 
 	// Send verify if successful upload
@@ -288,8 +496,16 @@ func (a *customAdapter) DoTransfer(ctx interface{}, t *Transfer, cb TransferProg
 	return nil
 }
 
-func newCustomAdapter(name string, dir Direction, path, args string, concurrent bool) *customAdapter {
-	c := &customAdapter{newAdapterBase(name, dir, nil), path, args, concurrent, 3}
+func newCustomAdapter(name string, dir Direction, path, args string, concurrent, streamMode bool, credentialMode string) *customAdapter {
+	c := &customAdapter{
+		adapterBase:         newAdapterBase(name, dir, nil),
+		path:                path,
+		args:                args,
+		concurrent:          concurrent,
+		originalConcurrency: 3,
+		streamMode:          streamMode,
+		credentialMode:      credentialMode,
+	}
 	// self implements impl
 	c.transferImpl = c
 	return c
@@ -314,10 +530,21 @@ func ConfigureCustomAdapters() {
 			} else {
 				direction = strings.ToLower(direction)
 			}
+			transferMode, _ := config.Config.GitConfig(fmt.Sprintf("lfs.customtransfer.%s.transfermode", name))
+			streamMode := strings.ToLower(transferMode) == "stream"
+
+			credentialMode, _ := config.Config.GitConfig(fmt.Sprintf("lfs.customtransfer.%s.credentials", name))
+			credentialMode = strings.ToLower(credentialMode)
+			switch credentialMode {
+			case credentialModeNetrc, credentialModeAskpass, credentialModeAll:
+				// recognised, use as-is
+			default:
+				credentialMode = credentialModeNone
+			}
 
 			// Separate closure for each since we need to capture vars above
 			newfunc := func(name string, dir Direction) TransferAdapter {
-				return newCustomAdapter(name, dir, path, args, concurrent)
+				return newCustomAdapter(name, dir, path, args, concurrent, streamMode, credentialMode)
 			}
 
 			if direction == "download" || direction == "both" {
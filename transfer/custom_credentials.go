@@ -0,0 +1,160 @@
+package transfer
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/github/git-lfs/api"
+	"github.com/github/git-lfs/config"
+	"github.com/github/git-lfs/subprocess"
+	"github.com/rubyist/tracerx"
+)
+
+// credentialMode* are the recognised values of
+// lfs.customtransfer.<name>.credentials.
+const (
+	credentialModeNone    = "none"
+	credentialModeNetrc   = "netrc"
+	credentialModeAskpass = "askpass"
+	credentialModeAll     = "all"
+)
+
+// customAdapterCredentials carries resolved HTTP basic auth credentials
+// for a single URL down to a custom transfer adapter, so adapters like an
+// S3 or Artifactory helper don't each have to reimplement netrc/credential
+// helper lookup themselves.
+type customAdapterCredentials struct {
+	Url      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// resolveEndpointCredentials resolves credentials for the LFS endpoint
+// this adapter's direction talks to. WorkerStarting calls this once per
+// worker process so most transfers never need their own lookup.
+func (a *customAdapter) resolveEndpointCredentials() *customAdapterCredentials {
+	if a.credentialMode == "" || a.credentialMode == credentialModeNone {
+		return nil
+	}
+
+	op := "upload"
+	if a.direction == Download {
+		op = "download"
+	}
+	endpoint := config.Config.Endpoint(op)
+	return resolveCredentialsForUrl(a.credentialMode, endpoint.Url)
+}
+
+// resolveCredentials resolves credentials for rel's host. DoTransfer calls
+// this per-transfer (in addition to the once-per-worker
+// resolveEndpointCredentials) so a redirect to a different host than the
+// configured remote's still gets the right credentials. Results are
+// cached per host on the adapter: in askpass/all mode, resolving
+// credentials execs `git credential fill`, and a large batch transferring
+// many objects to the same host has no reason to pay for that subprocess
+// more than once per host.
+func (a *customAdapter) resolveCredentials(rel *api.LinkRelation) *customAdapterCredentials {
+	if a.credentialMode == "" || a.credentialMode == credentialModeNone || rel == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rel.Href)
+	if err != nil || u.Host == "" {
+		return resolveCredentialsForUrl(a.credentialMode, rel.Href)
+	}
+
+	a.credCacheMu.Lock()
+	if creds, cached := a.credCache[u.Host]; cached {
+		a.credCacheMu.Unlock()
+		return creds
+	}
+	a.credCacheMu.Unlock()
+
+	creds := resolveCredentialsForUrl(a.credentialMode, rel.Href)
+
+	a.credCacheMu.Lock()
+	if a.credCache == nil {
+		a.credCache = make(map[string]*customAdapterCredentials)
+	}
+	a.credCache[u.Host] = creds
+	a.credCacheMu.Unlock()
+
+	return creds
+}
+
+func resolveCredentialsForUrl(mode, rawurl string) *customAdapterCredentials {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	if mode == credentialModeNetrc || mode == credentialModeAll {
+		if machine := config.Config.FindNetrcHost(u.Host); machine != nil {
+			return &customAdapterCredentials{
+				Url:      rawurl,
+				Username: machine.Login,
+				Password: machine.Password,
+			}
+		}
+		if mode == credentialModeNetrc {
+			return nil
+		}
+	}
+
+	if mode == credentialModeAskpass || mode == credentialModeAll {
+		creds, err := fillCredentialsFromHelper(u)
+		if err != nil {
+			tracerx.Printf("xfer: could not resolve credentials for %q via git credential helper: %v", rawurl, err)
+			return nil
+		}
+		return creds
+	}
+
+	return nil
+}
+
+// fillCredentialsFromHelper shells out to `git credential fill`, the same
+// mechanism git itself uses to invoke credential helpers (including
+// GIT_ASKPASS), and parses its key=value response.
+func fillCredentialsFromHelper(u *url.URL) (*customAdapterCredentials, error) {
+	cmd := subprocess.ExecCommand("git", "credential", "fill")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(stdin, "protocol=%s\nhost=%s\npath=%s\n\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"))
+	stdin.Close()
+
+	creds := &customAdapterCredentials{Url: u.String()}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "username":
+			creds.Username = kv[1]
+		case "password":
+			creds.Password = kv[1]
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	if creds.Username == "" && creds.Password == "" {
+		return nil, fmt.Errorf("git credential fill returned no credentials for %q", u.Host)
+	}
+	return creds, nil
+}
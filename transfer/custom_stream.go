@@ -0,0 +1,274 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/github/git-lfs/api"
+	"github.com/github/git-lfs/localstorage"
+)
+
+// streamFrameSize is the largest chunk of object data sent or received as
+// a single frame. Chosen to keep memory use bounded without chattering
+// the pipe with too many small writes.
+const streamFrameSize = 64 * 1024
+
+// writeFrame writes one length-prefixed frame: a 4-byte big-endian length
+// followed by that many bytes of payload. A zero-length frame terminates
+// the stream for the current transfer.
+func writeFrame(w io.Writer, data []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readFrame reads one length-prefixed frame. It returns (nil, nil) for
+// the zero-length frame that terminates the stream. The length prefix
+// comes from the worker process, so it's bounded to streamFrameSize
+// before we allocate anything for it: a worker that's crashed, wedged,
+// or simply misbehaving shouldn't be able to make us allocate an
+// attacker-chosen amount of memory.
+func readFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n == 0 {
+		return nil, nil
+	}
+	if n > streamFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum of %d", n, streamFrameSize)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readFrameCancelable reads one frame from customCtx's stdout pipe on a
+// background goroutine and returns as soon as either it completes or ctx
+// is cancelled. readFrame's underlying io.ReadFull blocks for as long as
+// a wedged worker keeps the pipe open without writing anything, so a
+// plain synchronous call here would make a stuck streaming download
+// uncancelable; closing the pipes out from under the blocked read is what
+// unblocks it on cancellation.
+func (a *customAdapter) readFrameCancelable(ctx context.Context, customCtx *customAdapterWorkerContext) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		data, err := readFrame(customCtx.bufferedOut)
+		resCh <- result{data, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		a.abortWorkerProcess(customCtx)
+		return nil, ctx.Err()
+	case r := <-resCh:
+		return r.data, r.err
+	}
+}
+
+// writeFrameCancelable is the streaming-upload counterpart of
+// readFrameCancelable: it writes one frame to customCtx's stdin on a
+// background goroutine and aborts the worker process if ctx is cancelled
+// before the write completes, so a worker that's stopped draining stdin
+// can't block a cancellation forever.
+func (a *customAdapter) writeFrameCancelable(ctx context.Context, customCtx *customAdapterWorkerContext, data []byte) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- writeFrame(customCtx.stdin, data)
+	}()
+
+	select {
+	case <-ctx.Done():
+		a.abortWorkerProcess(customCtx)
+		return ctx.Err()
+	case err := <-errCh:
+		return err
+	}
+}
+
+// doTransferOnceStream is the streaming-mode counterpart of the
+// path-based transfer loop in doTransferOnce. Instead of handing the
+// worker a temp file path and waiting for line-oriented progress
+// messages, object bytes are framed directly over the same stdin/stdout
+// pipes the line-oriented control messages use, letting the worker (and
+// us) pipeline the transfer instead of round-tripping through disk.
+func (a *customAdapter) doTransferOnceStream(ctx context.Context, customCtx *customAdapterWorkerContext, t *Transfer, authOkFunc func(), attempt int) error {
+	if a.direction == Download {
+		return a.streamDownload(ctx, customCtx, t, authOkFunc)
+	}
+	return a.streamUpload(ctx, customCtx, t, authOkFunc)
+}
+
+func (a *customAdapter) streamDownload(ctx context.Context, customCtx *customAdapterWorkerContext, t *Transfer, authOkFunc func()) error {
+	rel, ok := t.Object.Rel("download")
+	if !ok {
+		return fmt.Errorf("Object not found on the server.")
+	}
+	req := &customAdapterDownloadRequest{
+		Oid:         t.Object.Oid,
+		Size:        t.Object.Size,
+		Action:      rel,
+		Credentials: a.resolveCredentials(rel),
+	}
+	if err := a.sendMessage(customCtx, req); err != nil {
+		return newTransientError(err)
+	}
+
+	// Write to a temp file alongside the final object path rather than
+	// the object path itself: a worker that sends a truncated or
+	// corrupt stream must never leave a file behind that looks like a
+	// valid object with t.Object.Oid's name.
+	objectPath := localstorage.Objects().ObjectPath(t.Object.Oid)
+	out, err := ioutil.TempFile(filepath.Dir(objectPath), filepath.Base(objectPath)+"-tmp-")
+	if err != nil {
+		return fmt.Errorf("Could not create object file for %q: %v", t.Object.Oid, err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(out, hash)
+
+	var authCalled bool
+	var bytesSoFar int64
+	for {
+		frame, err := a.readFrameCancelable(ctx, customCtx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return newTransientError(err)
+		}
+		if frame == nil {
+			break // terminating zero-length frame
+		}
+		if _, err := w.Write(frame); err != nil {
+			return fmt.Errorf("Could not write object file for %q: %v", t.Object.Oid, err)
+		}
+		bytesSoFar += int64(len(frame))
+		a.manager.Progress(t.Object.Oid, bytesSoFar, len(frame))
+
+		if !authCalled && authOkFunc != nil {
+			authOkFunc()
+			authCalled = true
+		}
+	}
+
+	if err := a.readStreamResult(customCtx, t.Object.Oid); err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != t.Object.Oid {
+		return fmt.Errorf("Object %q is corrupt, got hash %q", t.Object.Oid, actual)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("Could not write object file for %q: %v", t.Object.Oid, err)
+	}
+	if err := os.Rename(out.Name(), objectPath); err != nil {
+		return fmt.Errorf("Could not move object file for %q into place: %v", t.Object.Oid, err)
+	}
+	return nil
+}
+
+func (a *customAdapter) streamUpload(ctx context.Context, customCtx *customAdapterWorkerContext, t *Transfer, authOkFunc func()) error {
+	rel, ok := t.Object.Rel("upload")
+	if !ok {
+		return fmt.Errorf("Object not found on the server.")
+	}
+	req := &customAdapterUploadRequest{
+		Oid:         t.Object.Oid,
+		Size:        t.Object.Size,
+		Action:      rel,
+		Credentials: a.resolveCredentials(rel),
+	}
+	if err := a.sendMessage(customCtx, req); err != nil {
+		return newTransientError(err)
+	}
+
+	in, err := os.Open(localstorage.Objects().ObjectPath(t.Object.Oid))
+	if err != nil {
+		return fmt.Errorf("Could not read object file for %q: %v", t.Object.Oid, err)
+	}
+	defer in.Close()
+
+	var authCalled bool
+	var bytesSoFar int64
+	buf := make([]byte, streamFrameSize)
+	for {
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if err := a.writeFrameCancelable(ctx, customCtx, buf[:n]); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return newTransientError(err)
+			}
+			bytesSoFar += int64(n)
+			a.manager.Progress(t.Object.Oid, bytesSoFar, n)
+			if !authCalled && authOkFunc != nil {
+				authOkFunc()
+				authCalled = true
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("Could not read object file for %q: %v", t.Object.Oid, readErr)
+		}
+	}
+
+	if err := a.writeFrameCancelable(ctx, customCtx, nil); err != nil { // terminating frame
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return newTransientError(err)
+	}
+
+	if err := a.readStreamResult(customCtx, t.Object.Oid); err != nil {
+		return err
+	}
+	return api.VerifyUpload(t.Object)
+}
+
+// readStreamResult reads the single customAdapterTransferResponse line
+// that follows a streamed transfer's final frame and translates an
+// embedded error into a Go error, classifying 5xx as transient.
+func (a *customAdapter) readStreamResult(customCtx *customAdapterWorkerContext, oid string) error {
+	var resp customAdapterTransferResponse
+	if _, err := a.readResponse(customCtx, []interface{}{&resp}); err != nil {
+		return newTransientError(err)
+	}
+	if resp.Oid != oid {
+		return fmt.Errorf("Unexpected oid %q in response, expecting %q", resp.Oid, oid)
+	}
+	if resp.Error != nil {
+		err := fmt.Errorf("Error transferring %q: %v", oid, resp.Error.Error())
+		if resp.Error.Code >= 500 {
+			return newTransientError(err)
+		}
+		return err
+	}
+	return nil
+}
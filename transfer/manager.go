@@ -0,0 +1,219 @@
+package transfer
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/github/git-lfs/config"
+	"github.com/rubyist/tracerx"
+)
+
+// TransientError wraps an error that is believed to be transient (a
+// network reset, an HTTP 5xx, an adapter process that crashed mid
+// transfer) and therefore worth retrying. Apart from net.Errors that
+// report a timeout or a temporary condition, errors that are not wrapped
+// in a TransientError are treated as fatal and fail the transfer
+// immediately.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string { return e.Err.Error() }
+
+// newTransientError wraps err so the TransferManager will retry it, up to
+// lfs.transfer.maxretries times. A nil err returns nil.
+func newTransientError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &TransientError{Err: err}
+}
+
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*TransientError); ok {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+// TransferManagerEvent is sent on the channel returned by Watch, once per
+// progress update and exactly once more (with Done set) to report the
+// final outcome of the transfer.
+type TransferManagerEvent struct {
+	Oid            string
+	BytesSoFar     int64
+	BytesSinceLast int
+	Done           bool
+	Err            error
+}
+
+// transferFunc performs a single attempt at transferring oid. It is
+// supplied by the adapter that owns the TransferManager and is retried
+// according to the manager's backoff policy whenever it returns a
+// TransientError (or a timeout/temporary net.Error).
+type transferFunc func(attempt int) error
+
+type transferJob struct {
+	oid string
+
+	mu       sync.Mutex
+	watchers []chan TransferManagerEvent
+	// finished and final are set, under mu, the moment run delivers this
+	// job's last event to its watchers. A Watch call that attaches after
+	// that point must not append to watchers (nothing will ever drain
+	// it again) and instead gets final handed to it directly.
+	finished bool
+	final    TransferManagerEvent
+}
+
+// TransferManager schedules, deduplicates and retries transfers on behalf
+// of a single TransferAdapter. Multiple callers asking to transfer the
+// same Oid share a single underlying transfer: the first caller starts
+// it, and every caller (including the first) receives its own Watch
+// channel fed from the same run. Work is bounded to maxConcurrency
+// simultaneous transfers so a large batch can't spawn unbounded adapter
+// processes or connections.
+type TransferManager struct {
+	name       string
+	maxRetries int
+	pool       chan struct{}
+
+	mu       sync.Mutex
+	inflight map[string]*transferJob
+}
+
+// NewTransferManager creates a TransferManager for the named adapter.
+// maxConcurrency bounds the number of transfers it will run at once; the
+// retry ceiling is read from lfs.transfer.maxretries (default 3).
+func NewTransferManager(name string, maxConcurrency int) *TransferManager {
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	return &TransferManager{
+		name:       name,
+		maxRetries: config.Config.Int("lfs.transfer.maxretries", 3),
+		pool:       make(chan struct{}, maxConcurrency),
+		inflight:   make(map[string]*transferJob),
+	}
+}
+
+// Watch enqueues fn to run for oid if no transfer for oid is already in
+// flight, then returns a channel of progress and completion events. If a
+// transfer for oid is already running, fn is discarded and the returned
+// channel is simply attached to the existing run, so the caller still
+// sees that transfer's progress and final result. ctx is only consulted
+// by the run this call starts (when no transfer for oid is already in
+// flight); a Watch that attaches to an existing run has no influence over
+// when that run gives up on retrying.
+func (m *TransferManager) Watch(ctx context.Context, oid string, fn transferFunc) <-chan TransferManagerEvent {
+	ch := make(chan TransferManagerEvent, 16)
+
+	m.mu.Lock()
+	job, exists := m.inflight[oid]
+	if !exists {
+		job = &transferJob{oid: oid}
+		m.inflight[oid] = job
+	}
+	m.mu.Unlock()
+
+	job.mu.Lock()
+	if job.finished {
+		// run already delivered this job's last event and moved on
+		// between our inflight lookup and this lock: attaching to
+		// watchers now would leave ch waiting on a run that's never
+		// coming back, so hand it the same final event directly.
+		final := job.final
+		job.mu.Unlock()
+		ch <- final
+		close(ch)
+		return ch
+	}
+	job.watchers = append(job.watchers, ch)
+	job.mu.Unlock()
+
+	if !exists {
+		go m.run(ctx, job, fn)
+	}
+
+	return ch
+}
+
+// Progress delivers a progress event to every watcher currently attached
+// to oid. It is a no-op once oid's transfer has finished and been removed
+// from the in-flight table.
+func (m *TransferManager) Progress(oid string, bytesSoFar int64, bytesSinceLast int) {
+	m.mu.Lock()
+	job, ok := m.inflight[oid]
+	m.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for _, w := range job.watchers {
+		w <- TransferManagerEvent{Oid: oid, BytesSoFar: bytesSoFar, BytesSinceLast: bytesSinceLast}
+	}
+}
+
+func (m *TransferManager) run(ctx context.Context, job *transferJob, fn transferFunc) {
+	m.pool <- struct{}{}
+	defer func() { <-m.pool }()
+
+	var err error
+retry:
+	for attempt := 0; ; attempt++ {
+		err = fn(attempt)
+		if err == nil || !isTransientError(err) || attempt >= m.maxRetries {
+			break
+		}
+
+		wait := backoffDuration(attempt)
+		tracerx.Printf("xfer: %q transfer of %q failed (attempt %d/%d), retrying in %v: %v",
+			m.name, job.oid, attempt+1, m.maxRetries+1, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			tracerx.Printf("xfer: %q transfer of %q cancelled during retry backoff", m.name, job.oid)
+			err = ctx.Err()
+			break retry
+		}
+	}
+
+	m.mu.Lock()
+	delete(m.inflight, job.oid)
+	m.mu.Unlock()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.finished = true
+	job.final = TransferManagerEvent{Oid: job.oid, Done: true, Err: err}
+	for _, w := range job.watchers {
+		w <- job.final
+		close(w)
+	}
+}
+
+const maxBackoff = 30 * time.Second
+
+// backoffDuration returns the delay before the retry following a failed
+// attempt (0-indexed): 1s, 2s, 4s... capped at maxBackoff, with up to 20%
+// jitter added so a batch of workers that failed together don't all
+// retry in lockstep.
+func backoffDuration(attempt int) time.Duration {
+	base := time.Second << uint(attempt)
+	if base <= 0 || base > maxBackoff {
+		base = maxBackoff
+	}
+	return base + time.Duration(rand.Int63n(int64(base)/5+1))
+}